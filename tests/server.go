@@ -1,20 +1,630 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// websocketMagic is the GUID RFC 6455 has clients and servers append to
+// the Sec-WebSocket-Key before hashing to derive Sec-WebSocket-Accept.
+const websocketMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
 )
 
+// requestRingSize caps how many requests the recorder keeps, so the
+// ring buffer's memory stays bounded regardless of how long the server
+// has been running.
+const requestRingSize = 256
+
+// maxGeneratedBytes caps how many bytes /bytes/{n} and /stream-bytes/{n}
+// will generate, so a huge n returns a clean 400 instead of an
+// out-of-range allocation.
+const maxGeneratedBytes = 32 << 20 // 32 MiB
+
 func main() {
 	port := os.Args[1]
 
-	http.HandleFunc("/", HelloServer)
-	fmt.Println(fmt.Sprintf("Starting at port %s", port))
+	useH2C := flag.Bool("h2c", false, "serve plaintext HTTP/2 (h2c) on top of HTTP/1.1")
+	tlsFlag := flag.Bool("tls", false, "serve HTTP/2 over TLS (h2); generates a self-signed cert unless -tls-cert/-tls-key are given")
+	tlsCert := flag.String("tls-cert", "", "path to a TLS certificate; together with -tls-key, enables HTTP/2 over TLS (h2)")
+	tlsKey := flag.String("tls-key", "", "path to the TLS certificate's private key")
+	maxBody := flag.Int("max-body", 4096, "maximum request body bytes the recorder hashes per request")
+	flag.CommandLine.Parse(os.Args[2:])
+
+	recorder := newRequestRecorder(requestRingSize, *maxBody)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", HelloServer)
+	mux.HandleFunc("/push", PushHandler)
+	mux.HandleFunc("/push/", PushHandler)
+	mux.HandleFunc("/trailers", TrailersHandler)
+	mux.HandleFunc("/stream", StreamHandler)
+	mux.HandleFunc("/status/", StatusHandler)
+	mux.HandleFunc("/delay/", DelayHandler)
+	mux.HandleFunc("/bytes/", BytesHandler)
+	mux.HandleFunc("/stream-bytes/", StreamBytesHandler)
+	mux.HandleFunc("/redirect/", RedirectHandler)
+	mux.HandleFunc("/gzip", GzipHandler)
+	mux.HandleFunc("/deflate", DeflateHandler)
+	mux.HandleFunc("/get", GetHandler)
+	mux.HandleFunc("/ws", WebSocketHandler)
+	mux.HandleFunc("/ws/close", WebSocketCloseHandler)
+	mux.HandleFunc("/__requests__", recorder.ListHandler)
+	mux.HandleFunc("/__reset__", recorder.ResetHandler)
+
 	bind := fmt.Sprintf("%s:%s", "0.0.0.0", port)
-	http.ListenAndServe(bind, nil)
+
+	var handler http.Handler = recorder.Middleware(mux)
+	if *useH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	server := &http.Server{
+		Addr:    bind,
+		Handler: handler,
+	}
+
+	if *tlsCert != "" && *tlsKey != "" {
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			fmt.Println(fmt.Sprintf("failed to configure http2: %s", err))
+			os.Exit(1)
+		}
+		fmt.Println(fmt.Sprintf("Starting h2 (TLS) at port %s", port))
+		server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		return
+	}
+
+	if *tlsFlag {
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			fmt.Println(fmt.Sprintf("failed to generate self-signed cert: %s", err))
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			fmt.Println(fmt.Sprintf("failed to configure http2: %s", err))
+			os.Exit(1)
+		}
+		fmt.Println(fmt.Sprintf("Starting h2 (self-signed TLS) at port %s", port))
+		server.ListenAndServeTLS("", "")
+		return
+	}
+
+	fmt.Println(fmt.Sprintf("Starting at port %s", port))
+	server.ListenAndServe()
 }
 
 func HelloServer(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello, %s!\r\n", r.URL.Path[1:])
 }
+
+// generateSelfSignedCert creates an in-memory, short-lived localhost
+// certificate so -tls can serve h2 without requiring the caller to hand
+// us a cert/key pair.
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// lastPathSegment returns the final "/"-separated segment of a request
+// path, e.g. "200" for "/status/200". It's the small path-parameter
+// parser the httpbin-style handlers below use instead of pulling in a
+// routing library.
+func lastPathSegment(path string) string {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	return parts[len(parts)-1]
+}
+
+// StatusHandler returns the HTTP status code given as the trailing path
+// segment, e.g. GET /status/404.
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(lastPathSegment(r.URL.Path))
+	if err != nil || code < 100 || code > 599 {
+		http.Error(w, "invalid status code", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(code)
+}
+
+// DelayHandler sleeps for the number of seconds given as the trailing
+// path segment before responding, returning early if the client cancels
+// the request.
+func DelayHandler(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseFloat(lastPathSegment(r.URL.Path), 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid delay: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+		fmt.Fprintf(w, "delayed %s seconds\r\n", lastPathSegment(r.URL.Path))
+	case <-r.Context().Done():
+	}
+}
+
+// BytesHandler writes N deterministic bytes, where N is the trailing
+// path segment, with a correct Content-Length.
+func BytesHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(lastPathSegment(r.URL.Path))
+	if err != nil || n < 0 || n > maxGeneratedBytes {
+		http.Error(w, "invalid byte count", http.StatusBadRequest)
+		return
+	}
+
+	body := deterministicBytes(n)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// StreamBytesHandler writes N bytes (trailing path segment) in chunks of
+// ?chunk=K bytes, flushing after each one so the response is sent with
+// Transfer-Encoding: chunked.
+func StreamBytesHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(lastPathSegment(r.URL.Path))
+	if err != nil || n < 0 || n > maxGeneratedBytes {
+		http.Error(w, "invalid byte count", http.StatusBadRequest)
+		return
+	}
+
+	chunkSize := 1024
+	if raw := r.URL.Query().Get("chunk"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			chunkSize = parsed
+		}
+	}
+
+	body := deterministicBytes(n)
+	flusher, _ := w.(http.Flusher)
+	for len(body) > 0 {
+		end := chunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+		w.Write(body[:end])
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[end:]
+	}
+}
+
+// deterministicBytes returns n bytes cycling through 0-255, used by the
+// byte-count endpoints so responses are reproducible without storing
+// large fixtures.
+func deterministicBytes(n int) []byte {
+	body := make([]byte, n)
+	for i := range body {
+		body[i] = byte(i % 256)
+	}
+	return body
+}
+
+// RedirectHandler chains N redirects (trailing path segment), each
+// pointing at /redirect/{n-1}, down to /get.
+func RedirectHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(lastPathSegment(r.URL.Path))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid redirect count: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if n <= 1 {
+		http.Redirect(w, r, "/get", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+}
+
+// GetHandler is the landing point for the /redirect/{n} chain.
+func GetHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "get\r\n")
+}
+
+// GzipHandler returns a gzip-compressed body with a matching
+// Content-Encoding header.
+func GzipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	fmt.Fprint(gz, "gzip\r\n")
+}
+
+// DeflateHandler returns a zlib-compressed (Content-Encoding: deflate)
+// body.
+func DeflateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Encoding", "deflate")
+	zw := zlib.NewWriter(w)
+	defer zw.Close()
+	fmt.Fprint(zw, "deflate\r\n")
+}
+
+// PushHandler serves a small asset and, when the connection supports it,
+// pushes it ahead of the client's request via http.Pusher.
+func PushHandler(w http.ResponseWriter, r *http.Request) {
+	const asset = "/push/asset.txt"
+	if pusher, ok := w.(http.Pusher); ok {
+		pusher.Push(asset, nil)
+	}
+	if r.URL.Path == asset {
+		fmt.Fprint(w, "pushed asset\r\n")
+		return
+	}
+	fmt.Fprint(w, "push\r\n")
+}
+
+// TrailersHandler writes a response body followed by an HTTP trailer so
+// HTTP/2 clients can verify trailer decoding.
+func TrailersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "X-Trailer")
+	fmt.Fprint(w, "trailers\r\n")
+	w.Header().Set("X-Trailer", "trailer-value")
+}
+
+// StreamHandler writes a number of chunks, flushing after each one so
+// HTTP/2 clients can verify DATA framing of a long-lived response.
+func StreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(w, "chunk %d\r\n", i)
+		if ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// WebSocketHandler performs the RFC 6455 handshake by hand over a
+// hijacked connection, then echoes back any text or binary frames it
+// receives until the client closes the connection, reassembling
+// fragmented messages (FIN=0 followed by continuation frames) before
+// echoing them back as one.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, reader, err := hijackForWebSocket(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	var fragmentOpcode byte
+	var fragments []byte
+
+	for {
+		fin, opcode, payload, err := readWSFrame(reader)
+		if err != nil {
+			return
+		}
+
+		switch opcode {
+		case wsOpContinuation:
+			fragments = append(fragments, payload...)
+			if fin {
+				if err := writeWSFrame(conn, fragmentOpcode, fragments); err != nil {
+					return
+				}
+				fragments = nil
+			}
+		case wsOpText, wsOpBinary:
+			if !fin {
+				fragmentOpcode = opcode
+				fragments = append([]byte(nil), payload...)
+				continue
+			}
+			if err := writeWSFrame(conn, opcode, payload); err != nil {
+				return
+			}
+		case wsOpClose:
+			writeWSFrame(conn, wsOpClose, payload)
+			return
+		case wsOpPing:
+			writeWSFrame(conn, wsOpPong, payload)
+		}
+	}
+}
+
+// WebSocketCloseHandler completes the handshake and immediately sends a
+// close frame carrying the status code from ?code=N, so Python tests can
+// assert proper close-code propagation.
+func WebSocketCloseHandler(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := hijackForWebSocket(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	code := 1000
+	if raw := r.URL.Query().Get("code"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil {
+			code = parsed
+		}
+	}
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	writeWSFrame(conn, wsOpClose, payload)
+}
+
+// hijackForWebSocket validates the WebSocket upgrade headers, writes the
+// 101 Switching Protocols response with the computed Sec-WebSocket-Accept,
+// and hands back the raw connection plus the buffered reader Hijack gave
+// us (which may already hold bytes the client sent right after the
+// handshake).
+func hijackForWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.Reader, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, nil, fmt.Errorf("missing Upgrade: websocket header")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, nil, fmt.Errorf("missing Sec-WebSocket-Key header")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accept := computeWSAccept(key)
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw.Reader, nil
+}
+
+// computeWSAccept derives Sec-WebSocket-Accept from the client's
+// Sec-WebSocket-Key per RFC 6455: SHA-1 of the key concatenated with the
+// WebSocket GUID, base64-encoded.
+func computeWSAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketMagic)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// readWSFrame reads a single WebSocket frame, reporting its FIN bit so
+// callers can reassemble fragmented messages, and unmasking the payload
+// if the client set the mask bit (clients are required to mask; this
+// server is lenient and accepts unmasked frames too).
+func readWSFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeWSFrame writes a single, final (FIN-set), unmasked server-to-client
+// frame with the given opcode and payload.
+func writeWSFrame(conn net.Conn, opcode byte, payload []byte) error {
+	var header []byte
+	length := len(payload)
+
+	switch {
+	case length <= 125:
+		header = []byte{0x80 | opcode, byte(length)}
+	case length <= 0xFFFF:
+		header = make([]byte, 4)
+		header[0] = 0x80 | opcode
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = make([]byte, 10)
+		header[0] = 0x80 | opcode
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+// requestRecord is a snapshot of one handled request, enough for Python
+// tests to assert connection reuse, Expect/100-continue, pipelining
+// order, and ALPN-negotiated protocol version.
+type requestRecord struct {
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Headers    http.Header   `json:"headers"`
+	BodyHash   string        `json:"body_hash"`
+	BodySize   int           `json:"body_size"`
+	Proto      string        `json:"proto"`
+	RemoteAddr string        `json:"remote_addr"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+// requestRecorder keeps a bounded, mutex-protected ring buffer of recent
+// requests so /__requests__ can serialize it for test assertions.
+type requestRecorder struct {
+	mu      sync.Mutex
+	records []requestRecord
+	size    int
+	maxBody int
+}
+
+func newRequestRecorder(size, maxBody int) *requestRecorder {
+	return &requestRecorder{size: size, maxBody: maxBody}
+}
+
+// Middleware wraps next, recording method, path, headers, a hash of the
+// (capped) body, timing, remote address and negotiated protocol for
+// every request, without disturbing what next sees of the body.
+func (rr *requestRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		hash, size := rr.captureBody(r)
+
+		next.ServeHTTP(w, r)
+
+		rr.add(requestRecord{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Headers:    r.Header.Clone(),
+			BodyHash:   hash,
+			BodySize:   size,
+			Proto:      r.Proto,
+			RemoteAddr: r.RemoteAddr,
+			StartedAt:  start,
+			Duration:   time.Since(start),
+		})
+	})
+}
+
+// captureBody reads up to rr.maxBody bytes of r.Body to hash them, then
+// reassembles r.Body so downstream handlers still see the full thing.
+// Capping the captured prefix keeps the recorder allocation-light on
+// large request bodies.
+func (rr *requestRecorder) captureBody(r *http.Request) (hash string, size int) {
+	if r.Body == nil {
+		return "", 0
+	}
+
+	captured, _ := io.ReadAll(io.LimitReader(r.Body, int64(rr.maxBody)))
+
+	sum := sha256.Sum256(captured)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(captured), r.Body), r.Body}
+
+	return hex.EncodeToString(sum[:]), len(captured)
+}
+
+func (rr *requestRecorder) add(rec requestRecord) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.records = append(rr.records, rec)
+	if len(rr.records) > rr.size {
+		rr.records = rr.records[len(rr.records)-rr.size:]
+	}
+}
+
+func (rr *requestRecorder) snapshot() []requestRecord {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	out := make([]requestRecord, len(rr.records))
+	copy(out, rr.records)
+	return out
+}
+
+// ListHandler serializes the recorded requests as JSON for
+// GET /__requests__.
+func (rr *requestRecorder) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rr.snapshot())
+}
+
+// ResetHandler clears the recorded requests for POST /__reset__.
+func (rr *requestRecorder) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	rr.records = nil
+	rr.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}